@@ -0,0 +1,41 @@
+// +build !windows
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// DefaultStopSignal is sent by Stop when the caller doesn't specify one.
+var DefaultStopSignal os.Signal = syscall.SIGTERM
+
+// setpgid makes c the leader of a new process group on start, so that
+// signalGroup/terminateGroup/killGroup can reach grandchildren too (e.g.
+// those spawned by a `bash -c` daemon), not just the direct child.
+func setpgid(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends sig to the entire process group led by p.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		s = syscall.SIGTERM
+	}
+	return syscall.Kill(-p.Pid, s)
+}
+
+// terminateGroup asks the process group led by p to shut down gracefully.
+func terminateGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+// killGroup hard-kills the process group led by p.
+func killGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
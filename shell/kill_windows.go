@@ -0,0 +1,38 @@
+// +build windows
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// DefaultStopSignal is sent by Stop when the caller doesn't specify one.
+// Windows has no signal delivery for arbitrary processes, so this is
+// unused by killTree but kept so callers can pass nil uniformly.
+var DefaultStopSignal os.Signal = os.Kill
+
+// setpgid is a no-op on Windows: killTree reaches the whole process tree
+// by PID via taskkill /T instead of relying on process groups.
+func setpgid(c *exec.Cmd) {}
+
+// signalGroup ignores sig - Windows can't deliver arbitrary signals to a
+// process tree - and always hard-kills it.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	return killTree(p)
+}
+
+// terminateGroup kills the process tree rooted at p.
+func terminateGroup(p *os.Process) error {
+	return killTree(p)
+}
+
+// killGroup kills the process tree rooted at p.
+func killGroup(p *os.Process) error {
+	return killTree(p)
+}
+
+func killTree(p *os.Process) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run()
+}
@@ -3,12 +3,16 @@ package shell
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cortesi/termlog"
 	"github.com/google/shlex"
@@ -16,10 +20,122 @@ import (
 
 var Default = "bash"
 
+// killGrace is how long execRunner waits for a process to exit after a
+// context is canceled before escalating from SIGTERM to SIGKILL.
+const killGrace = 5 * time.Second
+
 type Executor interface {
 	Name() string
-	Run(command string, log termlog.Stream, bufferr bool) (error, error, string)
-	Stop() error
+	// Run executes command, streaming output to log. It's a convenience
+	// wrapper around RunContext with a context that's never canceled.
+	Run(command string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte)
+	// RunContext executes command exactly like Run, but the invocation is
+	// aborted - SIGTERM, then SIGKILL after a grace period - if ctx is
+	// canceled or its deadline passes before the command exits.
+	RunContext(ctx context.Context, command string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte)
+	// Stop signals the process currently running under Run/RunContext, if
+	// any, sending sig to its entire process group. If the process hasn't
+	// exited by the time grace elapses, it's escalated to a hard kill.
+	// A nil sig uses DefaultStopSignal.
+	Stop(sig os.Signal, grace time.Duration) error
+}
+
+// ExecOptions carries per-invocation overrides for how a command is run,
+// on top of whatever an Executor would otherwise do by default.
+type ExecOptions struct {
+	// Dir sets the command's working directory. Empty means modd's own cwd.
+	Dir string
+	// Env is merged over os.Environ() - later entries win on key collision.
+	Env []string
+	// Stdin, if set, is connected to the command's standard input.
+	Stdin io.Reader
+	// ExtraFiles are passed through to the child as descriptors 3, 4, ...
+	ExtraFiles []*os.File
+	// MaxCaptureBytes caps how much output a capture buffer retains before
+	// truncating. Zero uses defaultMaxCaptureBytes.
+	MaxCaptureBytes int
+}
+
+// apply configures c according to opts.
+func (opts ExecOptions) apply(c *exec.Cmd) {
+	if opts.Dir != "" {
+		c.Dir = opts.Dir
+	}
+	if len(opts.Env) > 0 {
+		c.Env = append(os.Environ(), opts.Env...)
+	}
+	if opts.Stdin != nil {
+		c.Stdin = opts.Stdin
+	}
+	if len(opts.ExtraFiles) > 0 {
+		c.ExtraFiles = opts.ExtraFiles
+	}
+}
+
+// CaptureMode controls what execRunner buffers and returns alongside the
+// output it streams to the log.
+type CaptureMode int
+
+const (
+	// CaptureNone buffers nothing; the returned []byte is always nil.
+	CaptureNone CaptureMode = iota
+	// CaptureStderr buffers stderr only.
+	CaptureStderr
+	// CaptureBoth buffers stdout and stderr as two separate streams, and
+	// returns them concatenated, stdout first.
+	CaptureBoth
+	// CaptureInterleaved buffers stdout and stderr into a single stream, in
+	// the order lines actually arrive - the same jumble a terminal would
+	// show running the command directly.
+	CaptureInterleaved
+)
+
+// defaultMaxCaptureBytes caps a capture buffer when ExecOptions.MaxCaptureBytes
+// isn't set, so a chatty process can't buffer its way to an OOM.
+const defaultMaxCaptureBytes = 1 << 20 // 1MiB
+
+// capBuffer is a size-bounded, concurrency-safe line buffer. The first line
+// that would take it past max bytes is dropped, along with every line after
+// it, and an ellipsis marks the truncation.
+type capBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	max     int
+	trunced bool
+}
+
+func newCapBuffer(max int) *capBuffer {
+	if max <= 0 {
+		max = defaultMaxCaptureBytes
+	}
+	return &capBuffer{max: max}
+}
+
+func (c *capBuffer) WriteLine(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trunced {
+		return
+	}
+	if c.buf.Len()+len(s)+1 > c.max {
+		c.trunced = true
+		return
+	}
+	c.buf.WriteString(s)
+	c.buf.WriteByte('\n')
+}
+
+func (c *capBuffer) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.trunced && c.buf.Len() == 0 {
+		return nil
+	}
+	out := append([]byte{}, c.buf.Bytes()...)
+	if c.trunced {
+		out = append(out, "...\n"...)
+	}
+	return out
 }
 
 var shells = make(map[string]Executor)
@@ -28,6 +144,86 @@ func init() {
 	register(&Exec{})
 	register(&Bash{})
 	register(&Builtin{})
+	register(&PowerShell{})
+	register(&Cmd{})
+}
+
+// writeScript writes contents to a fresh temp file with the given extension
+// and returns its path. The caller is responsible for removing it once the
+// command has finished running.
+func writeScript(ext string, contents string) (string, error) {
+	f, err := ioutil.TempFile("", "modd-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0700); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// withTimeout derives a child context bounded by d, unless d is zero, in
+// which case ctx is returned unchanged along with a no-op cancel.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// procTracker records the *exec.Cmd currently running for an executor, so
+// that Stop can reach it. It's embedded in each Executor implementation.
+type procTracker struct {
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// track records c as the currently-running command, and returns a channel
+// that the caller must close once c has exited.
+func (t *procTracker) track(c *exec.Cmd) chan struct{} {
+	done := make(chan struct{})
+	t.mu.Lock()
+	t.cmd = c
+	t.done = done
+	t.mu.Unlock()
+	return done
+}
+
+func (t *procTracker) untrack(done chan struct{}) {
+	close(done)
+	t.mu.Lock()
+	t.cmd = nil
+	t.done = nil
+	t.mu.Unlock()
+}
+
+// Stop sends sig to the process group of the tracked command, if one is
+// running, and escalates to a hard kill if it's still alive after grace.
+func (t *procTracker) Stop(sig os.Signal, grace time.Duration) error {
+	t.mu.Lock()
+	c, done := t.cmd, t.done
+	t.mu.Unlock()
+	if c == nil || c.Process == nil {
+		return nil
+	}
+	if sig == nil {
+		sig = DefaultStopSignal
+	}
+	err := signalGroup(c.Process, sig)
+	select {
+	case <-done:
+	case <-time.After(grace):
+		killGroup(c.Process)
+		<-done
+	}
+	return err
 }
 
 // Register a new shell interface.
@@ -39,44 +235,106 @@ func register(i Executor) {
 	shells[name] = i
 }
 
-/* execRunner runs a command through exec, streaming output to logs. If bufferr
-is true, errors are buffered up and returned. Otherwise, the return string is
-always empty. */
-func execRunner(c *exec.Cmd, log termlog.Stream, bufferr bool) (
+/* execRunner runs a command through exec, streaming output to logs. capture
+controls what, if anything, is also buffered up and returned (see
+CaptureMode); opts.MaxCaptureBytes bounds that buffer, falling back to
+defaultMaxCaptureBytes. If ctx is canceled or times out before the command
+exits, the process group is sent SIGTERM, then killed outright if it's still
+alive after killGrace. If tracker is non-nil, the command is registered with
+it for the duration of the run, so that Stop can also reach it. opts is
+applied to c before it's started. */
+func execRunner(ctx context.Context, c *exec.Cmd, log termlog.Stream, capture CaptureMode, tracker *procTracker, opts ExecOptions) (
 	error, // Invocation error
 	error, // Process exit error
-	string, // Error buffer
+	[]byte, // Captured output
 ) {
+	opts.apply(c)
 	stdo, err := c.StdoutPipe()
 	if err != nil {
-		return err, nil, ""
+		return err, nil, nil
 	}
 	stde, err := c.StderrPipe()
 	if err != nil {
-		return err, nil, ""
+		return err, nil, nil
+	}
+
+	// outBuf/errBuf are the per-stream buffers for CaptureBoth; shared is the
+	// single interleaved buffer for CaptureInterleaved (stderr alone reuses
+	// it for CaptureStderr).
+	var outBuf, errBuf, shared *capBuffer
+	switch capture {
+	case CaptureStderr:
+		shared = newCapBuffer(opts.MaxCaptureBytes)
+	case CaptureBoth:
+		outBuf = newCapBuffer(opts.MaxCaptureBytes)
+		errBuf = newCapBuffer(opts.MaxCaptureBytes)
+	case CaptureInterleaved:
+		shared = newCapBuffer(opts.MaxCaptureBytes)
 	}
-	buff := new(bytes.Buffer)
-	mut := sync.Mutex{}
+
+	setpgid(c)
 	err = c.Start()
 	if err != nil {
-		return err, nil, ""
+		return err, nil, nil
 	}
+
+	var tracked chan struct{}
+	if tracker != nil {
+		tracked = tracker.track(c)
+		defer tracker.untrack(tracked)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			terminateGroup(c.Process)
+			t := time.NewTimer(killGrace)
+			defer t.Stop()
+			select {
+			case <-done:
+			case <-t.C:
+				killGroup(c.Process)
+			}
+		case <-done:
+		}
+	}()
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	go logOutput(
 		&wg, stde,
 		func(s string, args ...interface{}) {
 			log.Warn(s, args...)
-			if bufferr {
-				mut.Lock()
-				defer mut.Unlock()
-				fmt.Fprintf(buff, "%s\n", args...)
+			if capture == CaptureStderr || capture == CaptureInterleaved {
+				shared.WriteLine(fmt.Sprintf(s, args...))
+			} else if capture == CaptureBoth {
+				errBuf.WriteLine(fmt.Sprintf(s, args...))
+			}
+		},
+	)
+	go logOutput(
+		&wg, stdo,
+		func(s string, args ...interface{}) {
+			log.Say(s, args...)
+			if capture == CaptureInterleaved {
+				shared.WriteLine(fmt.Sprintf(s, args...))
+			} else if capture == CaptureBoth {
+				outBuf.WriteLine(fmt.Sprintf(s, args...))
 			}
 		},
 	)
-	go logOutput(&wg, stdo, log.Say)
 	wg.Wait()
-	return nil, c.Wait(), buff.String()
+	procErr := c.Wait()
+
+	switch capture {
+	case CaptureStderr, CaptureInterleaved:
+		return nil, procErr, shared.Bytes()
+	case CaptureBoth:
+		return nil, procErr, append(outBuf.Bytes(), errBuf.Bytes()...)
+	}
+	return nil, procErr, nil
 }
 
 func logOutput(wg *sync.WaitGroup, fp io.ReadCloser, out func(string, ...interface{})) {
@@ -91,39 +349,72 @@ func logOutput(wg *sync.WaitGroup, fp io.ReadCloser, out func(string, ...interfa
 	}
 }
 
-// GetExecutor retrieves an executor, and returns nil if it doesn't exist.
+// externalExecutorPrefix is prepended to a requested shell name to form the
+// binary GetExecutor looks up on PATH, e.g. "python" -> "modd-shell-python".
+const externalExecutorPrefix = "modd-shell-"
+
+// GetExecutor retrieves an executor. Built-ins and anything added via
+// Register are checked first; failing that, GetExecutor looks on PATH for a
+// binary named "modd-shell-<method>" and wraps it in an ExternalExecutor, the
+// same way git discovers subcommands. Returns nil if neither exists.
 func GetExecutor(method string) Executor {
-	exec, has := shells[method]
-	if !has {
-		return nil
+	if ex, has := shells[method]; has {
+		return ex
+	}
+	if path, err := exec.LookPath(externalExecutorPrefix + method); err == nil {
+		return &ExternalExecutor{name: method, path: path}
 	}
-	return exec
+	return nil
+}
+
+// Register makes a custom Executor available under its Name(), for
+// in-process embedders that want to add shells programmatically rather than
+// relying on the modd-shell-<name> PATH convention. Panics if the name is
+// already taken.
+func Register(i Executor) {
+	register(i)
 }
 
 // No shell, just execute the command raw.
-type Exec struct{}
+type Exec struct {
+	// Timeout, if non-zero, bounds how long Run will let the command
+	// execute before it's sent SIGTERM (then SIGKILL).
+	Timeout time.Duration
+
+	procTracker
+}
 
 func (r *Exec) Name() string {
 	return "exec"
 }
 
-func (r *Exec) Run(line string, log termlog.Stream, bufferr bool) (error, error, string) {
+func (r *Exec) Run(line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return r.RunContext(context.Background(), line, log, capture, opts)
+}
+
+func (r *Exec) RunContext(ctx context.Context, line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
 	ss, err := shlex.Split(line)
 	if err != nil {
-		return err, nil, ""
+		return err, nil, nil
 	}
 	if len(ss) == 0 {
-		return errors.New("No command defined"), nil, ""
+		return errors.New("No command defined"), nil, nil
 	}
-	return execRunner(exec.Command(ss[0], ss[1:]...), log, bufferr)
-}
-
-func (r *Exec) Stop() error {
-	return nil
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+	return execRunner(ctx, exec.Command(ss[0], ss[1:]...), log, capture, &r.procTracker, opts)
 }
 
 // Bash shell command.
-type Bash struct{}
+type Bash struct {
+	// Timeout, if non-zero, bounds how long Run will let the command
+	// execute before it's sent SIGTERM (then SIGKILL).
+	Timeout time.Duration
+
+	procTracker
+	mu         sync.Mutex
+	scriptPath string
+}
 
 func (b *Bash) Name() string {
 	return "bash"
@@ -139,33 +430,210 @@ func (b *Bash) getShell() (string, error) {
 	return "", fmt.Errorf("Could not find bash or sh on path.")
 }
 
-func (b *Bash) Run(line string, log termlog.Stream, bufferr bool) (error, error, string) {
+func (b *Bash) Run(line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return b.RunContext(context.Background(), line, log, capture, opts)
+}
+
+// RunContext executes line through bash (or sh). Multi-line blocks are
+// written to a temporary script file and run with that, rather than passed
+// inline via -c, since -c chokes on some multi-line constructs.
+func (b *Bash) RunContext(ctx context.Context, line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
 	sh, err := b.getShell()
 	if err != nil {
-		return err, nil, ""
+		return err, nil, nil
+	}
+	ctx, cancel := withTimeout(ctx, b.Timeout)
+	defer cancel()
+	if !strings.Contains(line, "\n") {
+		return execRunner(ctx, exec.Command(sh, "-c", line), log, capture, &b.procTracker, opts)
+	}
+	path, err := writeScript(".sh", line)
+	if err != nil {
+		return err, nil, nil
 	}
-	return execRunner(exec.Command(sh, "-c", line), log, bufferr)
+	b.mu.Lock()
+	b.scriptPath = path
+	b.mu.Unlock()
+	defer b.cleanup()
+	return execRunner(ctx, exec.Command(sh, path), log, capture, &b.procTracker, opts)
 }
 
-func (r *Bash) Stop() error {
-	return nil
+func (b *Bash) cleanup() {
+	b.mu.Lock()
+	path := b.scriptPath
+	b.scriptPath = ""
+	b.mu.Unlock()
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+func (b *Bash) Stop(sig os.Signal, grace time.Duration) error {
+	err := b.procTracker.Stop(sig, grace)
+	b.cleanup()
+	return err
+}
+
+// PowerShell runs command blocks through Windows PowerShell, via a temporary
+// .ps1 script file so multi-line blocks and quoting behave the way they
+// would in a real PowerShell session.
+type PowerShell struct {
+	// Timeout, if non-zero, bounds how long Run will let the command
+	// execute before it's sent SIGTERM (then SIGKILL).
+	Timeout time.Duration
+
+	procTracker
+	mu         sync.Mutex
+	scriptPath string
+}
+
+func (p *PowerShell) Name() string {
+	return "powershell"
+}
+
+func (p *PowerShell) Run(line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return p.RunContext(context.Background(), line, log, capture, opts)
+}
+
+func (p *PowerShell) RunContext(ctx context.Context, line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	path, err := writeScript(".ps1", line)
+	if err != nil {
+		return err, nil, nil
+	}
+	p.mu.Lock()
+	p.scriptPath = path
+	p.mu.Unlock()
+	defer p.cleanup()
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	return execRunner(ctx, exec.Command("powershell", "-NoProfile", "-NonInteractive", "-File", path), log, capture, &p.procTracker, opts)
+}
+
+func (p *PowerShell) cleanup() {
+	p.mu.Lock()
+	path := p.scriptPath
+	p.scriptPath = ""
+	p.mu.Unlock()
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+func (p *PowerShell) Stop(sig os.Signal, grace time.Duration) error {
+	err := p.procTracker.Stop(sig, grace)
+	p.cleanup()
+	return err
+}
+
+// Cmd runs command blocks through the Windows cmd.exe interpreter, via a
+// temporary .cmd script file so multi-line blocks behave the way they would
+// in a real cmd.exe session.
+type Cmd struct {
+	// Timeout, if non-zero, bounds how long Run will let the command
+	// execute before it's sent SIGTERM (then SIGKILL).
+	Timeout time.Duration
+
+	procTracker
+	mu         sync.Mutex
+	scriptPath string
+}
+
+func (c *Cmd) Name() string {
+	return "cmd"
+}
+
+func (c *Cmd) Run(line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return c.RunContext(context.Background(), line, log, capture, opts)
+}
+
+func (c *Cmd) RunContext(ctx context.Context, line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	path, err := writeScript(".cmd", line)
+	if err != nil {
+		return err, nil, nil
+	}
+	c.mu.Lock()
+	c.scriptPath = path
+	c.mu.Unlock()
+	defer c.cleanup()
+	ctx, cancel := withTimeout(ctx, c.Timeout)
+	defer cancel()
+	return execRunner(ctx, exec.Command("cmd", "/c", path), log, capture, &c.procTracker, opts)
+}
+
+func (c *Cmd) cleanup() {
+	c.mu.Lock()
+	path := c.scriptPath
+	c.scriptPath = ""
+	c.mu.Unlock()
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+func (c *Cmd) Stop(sig os.Signal, grace time.Duration) error {
+	err := c.procTracker.Stop(sig, grace)
+	c.cleanup()
+	return err
 }
 
 // Builtin shell command.
-type Builtin struct{}
+type Builtin struct {
+	// Timeout, if non-zero, bounds how long Run will let the command
+	// execute before it's sent SIGTERM (then SIGKILL).
+	Timeout time.Duration
+
+	procTracker
+}
 
 func (b *Builtin) Name() string {
 	return "builtin"
 }
 
-func (b *Builtin) Run(line string, log termlog.Stream, bufferr bool) (error, error, string) {
+func (b *Builtin) Run(line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return b.RunContext(context.Background(), line, log, capture, opts)
+}
+
+func (b *Builtin) RunContext(ctx context.Context, line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
 	path, err := os.Executable()
 	if err != nil {
-		return err, nil, ""
+		return err, nil, nil
 	}
-	return execRunner(exec.Command(path, "--exec", line), log, bufferr)
+	ctx, cancel := withTimeout(ctx, b.Timeout)
+	defer cancel()
+	return execRunner(ctx, exec.Command(path, "--exec", line), log, capture, &b.procTracker, opts)
 }
 
-func (r *Builtin) Stop() error {
-	return nil
+// ExternalExecutor wraps a modd-shell-<name> binary discovered on PATH. The
+// command block is piped to the binary's stdin, and its stdout/stderr are
+// streamed through execRunner like any other executor - this is how modd
+// lets the community add shells (fish, nushell, python, ...) without
+// patching modd itself.
+type ExternalExecutor struct {
+	name string
+	path string
+
+	// Timeout, if non-zero, bounds how long Run will let the command
+	// execute before it's sent SIGTERM (then SIGKILL).
+	Timeout time.Duration
+
+	procTracker
+}
+
+func (e *ExternalExecutor) Name() string {
+	return e.name
+}
+
+func (e *ExternalExecutor) Run(line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return e.RunContext(context.Background(), line, log, capture, opts)
+}
+
+// RunContext pipes line to the external binary's stdin. opts.Stdin is
+// ignored, since stdin already carries the command block.
+func (e *ExternalExecutor) RunContext(ctx context.Context, line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	ctx, cancel := withTimeout(ctx, e.Timeout)
+	defer cancel()
+	opts.Stdin = nil
+	c := exec.Command(e.path)
+	c.Stdin = strings.NewReader(line + "\n")
+	return execRunner(ctx, c, log, capture, &e.procTracker, opts)
 }
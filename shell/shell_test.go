@@ -1,16 +1,22 @@
 package shell
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cortesi/termlog"
 )
 
 type cmdTest struct {
 	cmd     string
-	bufferr bool
+	capture CaptureMode
+	opts    ExecOptions
 
 	logHas  string
 	buffHas string
@@ -20,14 +26,14 @@ type cmdTest struct {
 
 func testCmd(t *testing.T, ex Executor, ct cmdTest) {
 	lt := termlog.NewLogTest()
-	err, procerr, buff := ex.Run(ct.cmd, lt.Log.Stream(""), ct.bufferr)
+	err, procerr, buff := ex.Run(ct.cmd, lt.Log.Stream(""), ct.capture, ct.opts)
 	if (err != nil) != ct.err {
 		t.Errorf("Unexpected invocation error: %s", err)
 	}
 	if (procerr != nil) != ct.procerr {
 		t.Errorf("Unexpected process error: %s", err)
 	}
-	if ct.buffHas != "" && !strings.Contains(buff, ct.buffHas) {
+	if ct.buffHas != "" && !strings.Contains(string(buff), ct.buffHas) {
 		t.Errorf("Unexpected buffer return: %s", buff)
 	}
 	if ct.logHas != "" && !strings.Contains(lt.String(), ct.logHas) {
@@ -51,9 +57,33 @@ var bashTests = []cmdTest{
 	},
 	{
 		cmd:     "echo moddstderr >&2",
-		bufferr: true,
+		capture: CaptureStderr,
 		buffHas: "moddstderr",
 	},
+	{
+		cmd:    "echo moddline1\necho moddline2",
+		logHas: "moddline2",
+	},
+	{
+		cmd:    "echo $MODD_TEST_VAR",
+		opts:   ExecOptions{Env: []string{"MODD_TEST_VAR=moddenv"}},
+		logHas: "moddenv",
+	},
+	{
+		cmd:    "pwd",
+		opts:   ExecOptions{Dir: os.TempDir()},
+		logHas: strings.TrimRight(os.TempDir(), "/"),
+	},
+	{
+		cmd:     "echo moddout; echo modderr >&2",
+		capture: CaptureBoth,
+		buffHas: "moddout",
+	},
+	{
+		cmd:     "echo moddinterleaved >&2",
+		capture: CaptureInterleaved,
+		buffHas: "moddinterleaved",
+	},
 }
 
 func TestBash(t *testing.T) {
@@ -66,3 +96,149 @@ func TestBash(t *testing.T) {
 		testCmd(t, &b, tc)
 	}
 }
+
+func TestBashTimeout(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("skipping bash test")
+		return
+	}
+	b := Bash{Timeout: 50 * time.Millisecond}
+	lt := termlog.NewLogTest()
+	_, procerr, _ := b.Run("sleep 5; echo moddtimeout", lt.Log.Stream(""), CaptureNone, ExecOptions{})
+	if procerr == nil {
+		t.Error("expected a timed-out command to return a process error")
+	}
+	if strings.Contains(lt.String(), "moddtimeout") {
+		t.Error("command should have been killed before it could finish")
+	}
+}
+
+func TestBashStop(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("skipping bash test")
+		return
+	}
+	b := Bash{}
+	lt := termlog.NewLogTest()
+	result := make(chan struct{})
+	var procerr error
+	go func() {
+		_, procerr, _ = b.Run("sleep 5; echo moddstopped", lt.Log.Stream(""), CaptureNone, ExecOptions{})
+		close(result)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := b.Stop(nil, time.Second); err != nil {
+		t.Errorf("unexpected error stopping: %s", err)
+	}
+	select {
+	case <-result:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not terminate the running command in time")
+	}
+	if procerr == nil {
+		t.Error("expected a stopped command to return a process error")
+	}
+	if strings.Contains(lt.String(), "moddstopped") {
+		t.Error("command should have been stopped before it could finish")
+	}
+}
+
+func TestBashCaptureTruncation(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("skipping bash test")
+		return
+	}
+	b := Bash{}
+	lt := termlog.NewLogTest()
+	_, _, buff := b.Run(
+		"echo moddaaaaaaaaaa >&2",
+		lt.Log.Stream(""),
+		CaptureStderr,
+		ExecOptions{MaxCaptureBytes: 4},
+	)
+	if !strings.Contains(string(buff), "...") {
+		t.Errorf("expected truncated capture to be marked with an ellipsis, got: %s", buff)
+	}
+	if strings.Contains(string(buff), "moddaaaaaaaaaa") {
+		t.Errorf("expected capture to be truncated, got: %s", buff)
+	}
+}
+
+func TestPowerShell(t *testing.T) {
+	if _, err := exec.LookPath("powershell"); err != nil {
+		t.Skip("skipping powershell test")
+		return
+	}
+	p := PowerShell{}
+	testCmd(t, &p, cmdTest{
+		cmd:    "Write-Output moddtest",
+		logHas: "moddtest",
+	})
+}
+
+func TestExternalExecutor(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("skipping external executor test")
+		return
+	}
+	dir, err := ioutil.TempDir("", "modd-shell-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := "#!/bin/sh\nwhile read -r line; do echo \"ran: $line\"; done\n"
+	scriptPath := filepath.Join(dir, "modd-shell-moddexternal")
+	if err := ioutil.WriteFile(scriptPath, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	ex := GetExecutor("moddexternal")
+	if ex == nil {
+		t.Fatal("expected GetExecutor to find modd-shell-moddexternal on PATH")
+	}
+	if ex.Name() != "moddexternal" {
+		t.Errorf("unexpected executor name: %s", ex.Name())
+	}
+	testCmd(t, ex, cmdTest{
+		cmd:    "moddpayload",
+		logHas: "ran: moddpayload",
+	})
+}
+
+type fakeExecutor struct {
+	procTracker
+}
+
+func (f *fakeExecutor) Name() string { return "moddfake" }
+
+func (f *fakeExecutor) Run(line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return nil, nil, nil
+}
+
+func (f *fakeExecutor) RunContext(ctx context.Context, line string, log termlog.Stream, capture CaptureMode, opts ExecOptions) (error, error, []byte) {
+	return nil, nil, nil
+}
+
+func TestRegister(t *testing.T) {
+	Register(&fakeExecutor{})
+	if GetExecutor("moddfake") == nil {
+		t.Error("expected registered executor to be retrievable via GetExecutor")
+	}
+}
+
+func TestCmd(t *testing.T) {
+	if _, err := exec.LookPath("cmd"); err != nil {
+		t.Skip("skipping cmd test")
+		return
+	}
+	c := Cmd{}
+	testCmd(t, &c, cmdTest{
+		cmd:    "echo moddtest",
+		logHas: "moddtest",
+	})
+}